@@ -0,0 +1,66 @@
+// Package config loads the optional TOML configuration file that tunes
+// memcload's shard addresses, retry behaviour, and logging, as an
+// alternative to passing everything on the command line.
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Duration wraps time.Duration so it can be written in a config file as
+// a plain string, e.g. memcache_insert_attempt_delay = "200ms", instead of a raw
+// nanosecond integer.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, which BurntSushi/toml
+// uses to decode a TOML string into a Duration via time.ParseDuration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %s", text, err)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// Shard configures a single Memcached shard.
+type Shard struct {
+	Address     string   `toml:"address"`
+	DialTimeout Duration `toml:"dial_timeout"`
+}
+
+// Log configures the logger.
+type Log struct {
+	Level  string `toml:"level"`
+	Format string `toml:"format"`
+}
+
+// Config is the root of the TOML configuration file. Zero values mean
+// "not set in the file", so callers can tell an explicit override from
+// an absent one.
+type Config struct {
+	Shards                      map[string]Shard `toml:"shards"`
+	MemcacheInsertMaxAttempts   int              `toml:"memcache_insert_max_attempts"`
+	MemcacheInsertAttemptDelay  Duration         `toml:"memcache_insert_attempt_delay"`
+	MemcacheDialTimeout         Duration         `toml:"memcache_dial_timeout"`
+	AcceptableInvalidRecordRate float64          `toml:"acceptable_invalid_record_rate"`
+	FileWorkers                 int              `toml:"file_workers"`
+	ParseWorkers                int              `toml:"parse_workers"`
+	Log                         Log              `toml:"log"`
+}
+
+// Load reads and decodes the TOML configuration file at path.
+func Load(path string) (Config, error) {
+	var cfg Config
+
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return cfg, fmt.Errorf("could not load config %s: %s", path, err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "memcload.toml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRoundTrip(t *testing.T) {
+	path := writeConfig(t, `
+memcache_insert_max_attempts = 3
+memcache_insert_attempt_delay = "50ms"
+memcache_dial_timeout = "2s"
+acceptable_invalid_record_rate = 0.05
+file_workers = 8
+parse_workers = 4
+
+[log]
+level = "debug"
+format = "json"
+
+[shards.idfa]
+address = "127.0.0.1:33013"
+
+[shards.custom]
+address = "127.0.0.1:34000"
+dial_timeout = "500ms"
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.MemcacheInsertMaxAttempts != 3 {
+		t.Errorf("MemcacheInsertMaxAttempts: got %d, want 3", cfg.MemcacheInsertMaxAttempts)
+	}
+	if cfg.MemcacheInsertAttemptDelay.Duration != 50*time.Millisecond {
+		t.Errorf("MemcacheInsertAttemptDelay: got %s, want 50ms", cfg.MemcacheInsertAttemptDelay.Duration)
+	}
+	if cfg.MemcacheDialTimeout.Duration != 2*time.Second {
+		t.Errorf("MemcacheDialTimeout: got %s, want 2s", cfg.MemcacheDialTimeout.Duration)
+	}
+	if cfg.AcceptableInvalidRecordRate != 0.05 {
+		t.Errorf("AcceptableInvalidRecordRate: got %f, want 0.05", cfg.AcceptableInvalidRecordRate)
+	}
+	if cfg.FileWorkers != 8 {
+		t.Errorf("FileWorkers: got %d, want 8", cfg.FileWorkers)
+	}
+	if cfg.ParseWorkers != 4 {
+		t.Errorf("ParseWorkers: got %d, want 4", cfg.ParseWorkers)
+	}
+	if cfg.Log.Level != "debug" || cfg.Log.Format != "json" {
+		t.Errorf("Log: got %+v", cfg.Log)
+	}
+
+	idfa, ok := cfg.Shards["idfa"]
+	if !ok || idfa.Address != "127.0.0.1:33013" {
+		t.Errorf("Shards[idfa]: got %+v", idfa)
+	}
+
+	custom, ok := cfg.Shards["custom"]
+	if !ok || custom.Address != "127.0.0.1:34000" || custom.DialTimeout.Duration != 500*time.Millisecond {
+		t.Errorf("Shards[custom]: got %+v", custom)
+	}
+}
+
+func TestLoadMalformedTOML(t *testing.T) {
+	path := writeConfig(t, `this is not valid toml =`)
+
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for malformed TOML, got nil")
+	}
+}
+
+func TestLoadMalformedDuration(t *testing.T) {
+	path := writeConfig(t, `memcache_insert_attempt_delay = "not-a-duration"`)
+
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for an unparsable duration, got nil")
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("expected an error for a missing file, got nil")
+	}
+}
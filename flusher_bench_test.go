@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// startFakeMemcached runs a minimal in-process server that understands
+// just enough of the memcached text protocol to answer "set" with
+// "STORED", so the benchmarks below don't depend on a real cluster being
+// reachable. It returns the address to dial and a func to shut it down.
+func startFakeMemcached(tb testing.TB) (addr string, stop func()) {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Skipf("could not start fake Memcached: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeMemcached(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func serveFakeMemcached(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := bytes.Fields([]byte(line))
+		if len(fields) < 5 || string(fields[0]) != "set" {
+			continue
+		}
+
+		size, err := strconv.Atoi(string(fields[4]))
+		if err != nil {
+			return
+		}
+
+		payload := make([]byte, size+2) // value plus trailing "\r\n"
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return
+		}
+
+		conn.Write([]byte("STORED\r\n"))
+	}
+}
+
+// BenchmarkInsertPerRecord models the old code path that issued one
+// blocking client.Set per record.
+func BenchmarkInsertPerRecord(b *testing.B) {
+	addr, stop := startFakeMemcached(b)
+	defer stop()
+
+	client := memcache.New(addr)
+	item := memcache.Item{Key: "gaid:bench", Value: []byte("payload")}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Set(&item); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInsertOverlappedBatches exercises the Flusher path introduced
+// to replace the per-record Sets: batches of Sets overlap across up to
+// maxInFlightBatches goroutines instead of each Set blocking the caller,
+// though individual Sets still round-trip one at a time. Submitting
+// every item before waiting on any result mirrors how ProcessLogFile
+// drives a Flusher: parsing and submission race ahead of confirmation so
+// batches fill on size instead of trickling in at one per waiting
+// goroutine.
+func BenchmarkInsertOverlappedBatches(b *testing.B) {
+	addr, stop := startFakeMemcached(b)
+	defer stop()
+
+	client := memcache.New(addr)
+	sink := NewMemcacheSink(client)
+	flusher := NewFlusher(sink, "gaid", 100, 10*time.Millisecond, DefaultMemcacheInsertMaxAttempts, DefaultMemcacheInsertAttemptDelay)
+
+	b.ResetTimer()
+	results := make([]<-chan error, b.N)
+	for i := 0; i < b.N; i++ {
+		results[i] = flusher.Submit("gaid:bench", []byte("payload"))
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	flusher.Close()
+}
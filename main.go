@@ -3,46 +3,65 @@ package main
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
 	"github.com/stkrizh/otus-go-memcload/appsinstalled"
+	"github.com/stkrizh/otus-go-memcload/config"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
-	// AcceptableInvalidRecordRate defines the maximum portion of invalid records
-	// in a log file
-	AcceptableInvalidRecordRate = 0.01
-	// MemcacheInsertMaxAttempts defines how many attempts would be to
-	// insert a record to Memcached
-	MemcacheInsertMaxAttempts = 5
-	// MemcacheInsertAttemptDelay defines delay between insertion attempts
-	MemcacheInsertAttemptDelay = 200 * time.Millisecond
+	// DefaultAcceptableInvalidRecordRate defines the maximum portion of
+	// invalid records in a log file, unless overridden by flag or config.
+	DefaultAcceptableInvalidRecordRate = 0.01
+	// DefaultMemcacheInsertMaxAttempts defines how many attempts would be
+	// to insert a record to Memcached, unless overridden by flag or config.
+	DefaultMemcacheInsertMaxAttempts = 5
+	// DefaultMemcacheInsertAttemptDelay defines the delay between insertion
+	// attempts, unless overridden by flag or config.
+	DefaultMemcacheInsertAttemptDelay = 200 * time.Millisecond
 )
 
 // Options for command line interface
 type Options struct {
-	Pattern                string
-	IDFA, GAID, ADID, DVID string
-	Dry, Debug             bool
+	Pattern                     string
+	IDFA, GAID, ADID, DVID      string
+	Dry, Debug                  bool
+	DrySinkPath                 string
+	BatchSize                   int
+	FlushInterval               time.Duration
+	ConfigPath                  string
+	MetricsAddr                 string
+	Shards                      map[string]config.Shard
+	MemcacheInsertMaxAttempts   int
+	MemcacheInsertAttemptDelay  time.Duration
+	MemcacheDialTimeout         time.Duration
+	AcceptableInvalidRecordRate float64
+	FileWorkers                 int
+	ParseWorkers                int
 }
 
 // Job keeps data for processing with goroutines
 type Job struct {
-	Clients map[string]*memcache.Client
-	File    string
-	Dry     bool
-	Index   int
+	Flushers                    map[string]*Flusher
+	File                        string
+	Dry                         bool
+	AcceptableInvalidRecordRate float64
 }
 
 // Record represents one data parsed from one line of a log file.
@@ -54,8 +73,21 @@ type Record struct {
 	Apps []uint32
 }
 
-// Insert record from a log file to Memcached
-func (record *Record) Insert(clients map[string]*memcache.Client, dry bool) bool {
+// immediateResult returns an already-resolved result channel, for the
+// call sites that know a record's outcome before ever reaching a Flusher.
+func immediateResult(err error) <-chan error {
+	result := make(chan error, 1)
+	result <- err
+	close(result)
+	return result
+}
+
+// Insert queues record for insertion into Memcached and returns a
+// channel that receives the outcome once the batch containing it has
+// been flushed. With dry set it only logs the record, and it does not
+// queue a record that fails to serialize or has no Flusher for its device
+// type; in those cases the returned channel is already resolved.
+func (record *Record) Insert(flushers map[string]*Flusher, dry bool) <-chan error {
 	recordProto := &appsinstalled.UserApps{
 		Lon:  &record.Lon,
 		Lat:  &record.Lat,
@@ -67,33 +99,22 @@ func (record *Record) Insert(clients map[string]*memcache.Client, dry bool) bool
 	if dry {
 		messageText := proto.MarshalTextString(recordProto)
 		log.Debugf("%s -> %s\n", key, strings.Replace(messageText, "\n", " ", -1))
-		return true
+		return immediateResult(nil)
 	}
 
 	message, err := proto.Marshal(recordProto)
 	if err != nil {
 		log.Warnln("Could not serialize record:", record)
-		return false
+		return immediateResult(err)
 	}
 
-	client, ok := clients[record.Type]
+	flusher, ok := flushers[record.Type]
 	if !ok {
 		log.Warnln("Unexpected device type:", record.Type)
-		return false
-	}
-
-	item := memcache.Item{Key: key, Value: message}
-	for attempt := 0; attempt < MemcacheInsertMaxAttempts; attempt++ {
-		err := client.Set(&item)
-		if err != nil {
-			time.Sleep(MemcacheInsertAttemptDelay)
-			continue
-		}
-		return true
+		return immediateResult(errors.New("unexpected device type"))
 	}
 
-	log.Warnf("Could not connect to Memcached: %s\n", record.Type)
-	return false
+	return flusher.Submit(key, message)
 }
 
 // ParseRecord parses a new Record from raw row that must contain
@@ -133,9 +154,54 @@ func ParseRecord(row string) (Record, error) {
 	return record, nil
 }
 
-// ProcessLogFile reads file specified by `path` argument and
-// processes each row of this file
-func ProcessLogFile(clients map[string]*memcache.Client, dry bool, path string) {
+// progressCheckpointLines bounds how many confirmed-but-unpersisted lines
+// ProcessLogFile lets build up before it writes a new progress offset. A
+// crash between checkpoints reprocesses the lines committed since the last
+// checkpoint plus any still in flight; once an insert failure freezes the
+// checkpoint, everything after the last written offset is reprocessed.
+const progressCheckpointLines = 1000
+
+// rawLine is one as-yet-unparsed line read from a log file, tagged with its
+// 1-based position so out-of-order completion across parseWorkers can still
+// be checkpointed in order.
+type rawLine struct {
+	lineNum int
+	text    string
+}
+
+// lineOutcome reports whether the record at lineNum was ultimately
+// confirmed or failed, once its result channel resolved. parseFailed
+// marks a permanent failure (the line itself was malformed, so retrying
+// it would fail again), as opposed to an insert failure, which is
+// transient and worth re-attempting on a crash-resume.
+type lineOutcome struct {
+	lineNum     int
+	failed      bool
+	parseFailed bool
+}
+
+// checkpointDecision reports whether the checkpoint may advance past
+// outcome's line, given whether a transient insert failure has already
+// been seen earlier in this run. A parse failure is permanent and within
+// the rate acceptableInvalidRecordRate already tolerates, so it doesn't
+// stop the checkpoint from advancing; an insert failure might succeed on
+// retry, so resume must see that line again, which freezes the
+// checkpoint for the rest of the file.
+func checkpointDecision(outcome lineOutcome, sawInsertFailure bool) (advance, nowSawInsertFailure bool) {
+	if outcome.failed && !outcome.parseFailed {
+		return false, true
+	}
+	return !sawInsertFailure, sawInsertFailure
+}
+
+// ProcessLogFile reads file specified by `path` argument and processes each
+// row of this file, fanning line parsing out across parseWorkers goroutines
+// and periodically recording a progress checkpoint so a crashed run resumes
+// past already-confirmed lines instead of reprocessing the whole file. It
+// returns true once the file has been accepted cleanly, which is the
+// caller's signal that it may DotRename the file and that the progress
+// checkpoint is no longer needed.
+func ProcessLogFile(flushers map[string]*Flusher, dry bool, path string, acceptableInvalidRecordRate float64, parseWorkers int) bool {
 	file, err := os.Open(path)
 
 	if err != nil {
@@ -153,40 +219,135 @@ func ProcessLogFile(clients map[string]*memcache.Client, dry bool, path string)
 
 	log.Infof("Processing %s\n", path)
 
+	startLine := readProgress(path)
+	if startLine > 0 {
+		log.Infof("Resuming %s from line %d\n", path, startLine)
+	}
+
 	scanner := bufio.NewScanner(gz)
 	scanner.Split(bufio.ScanLines)
 
-	var total, failed float64 = 0.0, 0.0
-
-	for scanner.Scan() {
-		row := scanner.Text()
-		total++
-
-		record, err := ParseRecord(row)
-		if err != nil {
-			log.Warnf("%s for: %s", err, row)
-			failed++
-			continue
+	rawLines := make(chan rawLine, parseWorkers*4)
+	outcomes := make(chan lineOutcome, parseWorkers*4)
+
+	// awaiters tracks the goroutines spawned below to wait on a submitted
+	// record's result, so close(outcomes) only happens once every one of
+	// them has reported in, not merely once parseWorkers are done parsing.
+	var parsers, awaiters sync.WaitGroup
+	parsers.Add(parseWorkers)
+	for i := 0; i < parseWorkers; i++ {
+		go func() {
+			defer parsers.Done()
+			for rl := range rawLines {
+				linesReadTotal.Inc()
+
+				record, err := ParseRecord(rl.text)
+				if err != nil {
+					log.Warnf("%s for: %s", err, rl.text)
+					parseFailuresTotal.Inc()
+					outcomes <- lineOutcome{lineNum: rl.lineNum, failed: true, parseFailed: true}
+					continue
+				}
+
+				// record.Insert only blocks long enough to queue the item on
+				// its shard's Flusher (bounded by batchSize), not until the
+				// batch is actually flushed. Waiting for that result here
+				// would cap in-flight records at parseWorkers, far below
+				// batchSize, so batches would rarely fill and throughput
+				// would be throttled to roughly one flushInterval tick per
+				// parseWorkers records. Awaiting it on its own goroutine
+				// instead lets this worker move straight on to the next
+				// line, so submissions arrive fast enough for batches to
+				// fill on size rather than timing out on flushInterval.
+				result := record.Insert(flushers, dry)
+				awaiters.Add(1)
+				go func(lineNum int, result <-chan error) {
+					defer awaiters.Done()
+					outcomes <- lineOutcome{lineNum: lineNum, failed: <-result != nil}
+				}(rl.lineNum, result)
+			}
+		}()
+	}
+	go func() {
+		parsers.Wait()
+		awaiters.Wait()
+		close(outcomes)
+	}()
+
+	go func() {
+		defer close(rawLines)
+		var lineNum int
+		for scanner.Scan() {
+			lineNum++
+			if lineNum <= startLine {
+				continue
+			}
+			rawLines <- rawLine{lineNum: lineNum, text: scanner.Text()}
 		}
-
-		ok := record.Insert(clients, dry)
-		if !ok {
-			failed++
+	}()
+
+	// outcomes can arrive out of order since parseWorkers race against
+	// each other, so pendingOutcomes buffers the stragglers until the
+	// contiguous run starting at nextToCommit catches up, which is what
+	// lets progress be checkpointed as a single confirmed offset.
+	var total, failed float64
+	pendingOutcomes := make(map[int]lineOutcome)
+	nextToCommit := startLine + 1
+	confirmedThrough := startLine
+	sawInsertFailure := false
+	sinceCheckpoint := 0
+
+	for outcome := range outcomes {
+		pendingOutcomes[outcome.lineNum] = outcome
+
+		for {
+			pending, ok := pendingOutcomes[nextToCommit]
+			if !ok {
+				break
+			}
+			delete(pendingOutcomes, nextToCommit)
+
+			total++
+			if pending.failed {
+				failed++
+			}
+			var advance bool
+			advance, sawInsertFailure = checkpointDecision(pending, sawInsertFailure)
+			if advance {
+				confirmedThrough = nextToCommit
+			}
+			nextToCommit++
+			sinceCheckpoint++
+
+			if sinceCheckpoint >= progressCheckpointLines {
+				if !sawInsertFailure {
+					if err := writeProgress(path, confirmedThrough); err != nil {
+						log.Warnf("Could not checkpoint progress for %s: %s", path, err)
+					}
+				}
+				sinceCheckpoint = 0
+			}
 		}
-
 	}
 
-	if total > 0 && failed/total > AcceptableInvalidRecordRate {
+	if total > 0 && failed/total > acceptableInvalidRecordRate {
 		log.Errorf(
 			"Too many invalid records in %s (Total: %d | Error: %d)\n",
 			path,
 			int(total),
 			int(failed),
 		)
-		return
+		// The file is left in place for a later run, so its progress file
+		// must not point past unaccepted lines: clear it so the retry
+		// reprocesses the whole file instead of silently skipping straight
+		// to EOF next time.
+		clearProgress(path)
+		return false
 	}
 
 	log.Infof("Done %s (Total: %d | Error: %d)\n", path, int(total), int(failed))
+	clearProgress(path)
+	return true
 }
 
 // DotRename renames processed log file by prepending its name with "."
@@ -199,13 +360,41 @@ func DotRename(path string) {
 	}
 }
 
-func worker(jobs chan Job, results []chan string) {
-	for job := range jobs {
-		ProcessLogFile(job.Clients, job.Dry, job.File)
-		results[job.Index] <- job.File
+// processResult reports what happened to one Job, so results consumers
+// know whether DotRename is safe to run.
+type processResult struct {
+	File  string
+	Clean bool
+}
+
+// worker pulls Jobs off jobs until it is closed or ctx is cancelled,
+// recording each outcome under its file path in results (guarded by
+// resultsMu) rather than returning it positionally, since jobs no longer
+// maps one-to-one to a dedicated goroutine. It stops picking up new jobs
+// once ctx is cancelled, but a job already in progress runs to completion
+// so its in-flight batches are drained rather than abandoned.
+func worker(ctx context.Context, jobs <-chan Job, parseWorkers int, results map[string]processResult, resultsMu *sync.Mutex) error {
+	for {
+		select {
+		case job, ok := <-jobs:
+			if !ok {
+				return nil
+			}
+			clean := ProcessLogFile(job.Flushers, job.Dry, job.File, job.AcceptableInvalidRecordRate, parseWorkers)
+
+			resultsMu.Lock()
+			results[job.File] = processResult{File: job.File, Clean: clean}
+			resultsMu.Unlock()
+		case <-ctx.Done():
+			return nil
+		}
 	}
 }
 
+// parseCommandLine parses flags and, if -config is given, layers a TOML
+// config.Config underneath them: a flag the user actually typed always
+// wins, a value left at its flag default falls back to the config file,
+// and anything neither sets falls back to the package defaults.
 func parseCommandLine() Options {
 	var options Options
 
@@ -215,20 +404,100 @@ func parseCommandLine() Options {
 	flag.StringVar(&options.ADID, "adid", "127.0.0.1:33015", "")
 	flag.StringVar(&options.DVID, "dvid", "127.0.0.1:33016", "")
 	flag.BoolVar(&options.Dry, "dry", false, "Dry run (without interaction with Memcached)")
+	flag.StringVar(&options.DrySinkPath, "dry-output", "", "With -dry, persist records as length-prefixed frames to this gzip file instead of just logging them")
 	flag.BoolVar(&options.Debug, "debug", false, "Show debug messages")
+	flag.IntVar(&options.BatchSize, "batch-size", 100, "Number of records to accumulate per shard before flushing a batch to Memcached")
+	flag.DurationVar(&options.FlushInterval, "flush-interval", time.Second, "Maximum time to hold a partial batch before flushing it to Memcached")
+	flag.StringVar(&options.ConfigPath, "config", "", "Path to a TOML config file (see config.Config); flags override its values")
+	flag.IntVar(&options.MemcacheInsertMaxAttempts, "memcache-max-attempts", DefaultMemcacheInsertMaxAttempts, "How many attempts to insert a record into Memcached")
+	flag.DurationVar(&options.MemcacheInsertAttemptDelay, "memcache-attempt-delay", DefaultMemcacheInsertAttemptDelay, "Delay between insertion attempts")
+	flag.Float64Var(&options.AcceptableInvalidRecordRate, "acceptable-invalid-rate", DefaultAcceptableInvalidRecordRate, "Maximum portion of invalid records tolerated in a log file")
+	flag.DurationVar(&options.MemcacheDialTimeout, "memcache-dial-timeout", 0, "Default dial/read/write timeout applied to shards without their own config override (0 keeps the client library default)")
+	flag.IntVar(&options.FileWorkers, "file-workers", 0, "Number of files processed concurrently (0 lets the config file or a built-in default decide)")
+	flag.IntVar(&options.ParseWorkers, "parse-workers", 0, "Number of goroutines parsing lines within a single file (0 lets the config file or a built-in default decide)")
+	flag.StringVar(&options.MetricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics and /healthz on, e.g. :9090 (disabled if empty)")
 	flag.Parse()
 
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	options.Shards = map[string]config.Shard{
+		"idfa": {Address: options.IDFA},
+		"gaid": {Address: options.GAID},
+		"adid": {Address: options.ADID},
+		"dvid": {Address: options.DVID},
+	}
+
+	if options.ConfigPath != "" {
+		cfg, err := config.Load(options.ConfigPath)
+		if err != nil {
+			log.Fatalf("Could not load config: %s", err)
+		}
+
+		for deviceType, shard := range cfg.Shards {
+			options.Shards[deviceType] = shard
+		}
+		// The four legacy address flags still win over the file if the
+		// user actually passed them.
+		legacyAddresses := map[string]string{"idfa": options.IDFA, "gaid": options.GAID, "adid": options.ADID, "dvid": options.DVID}
+		for deviceType, address := range legacyAddresses {
+			if explicit[deviceType] {
+				options.Shards[deviceType] = config.Shard{Address: address}
+			}
+		}
+
+		if !explicit["memcache-max-attempts"] && cfg.MemcacheInsertMaxAttempts != 0 {
+			options.MemcacheInsertMaxAttempts = cfg.MemcacheInsertMaxAttempts
+		}
+		if !explicit["memcache-attempt-delay"] && cfg.MemcacheInsertAttemptDelay.Duration != 0 {
+			options.MemcacheInsertAttemptDelay = cfg.MemcacheInsertAttemptDelay.Duration
+		}
+		if !explicit["acceptable-invalid-rate"] && cfg.AcceptableInvalidRecordRate != 0 {
+			options.AcceptableInvalidRecordRate = cfg.AcceptableInvalidRecordRate
+		}
+		if !explicit["memcache-dial-timeout"] && cfg.MemcacheDialTimeout.Duration != 0 {
+			options.MemcacheDialTimeout = cfg.MemcacheDialTimeout.Duration
+		}
+		if !explicit["file-workers"] && cfg.FileWorkers != 0 {
+			options.FileWorkers = cfg.FileWorkers
+		}
+		if !explicit["parse-workers"] && cfg.ParseWorkers != 0 {
+			options.ParseWorkers = cfg.ParseWorkers
+		}
+		if !explicit["debug"] && cfg.Log.Level != "" {
+			if level, err := log.ParseLevel(cfg.Log.Level); err == nil {
+				log.SetLevel(level)
+			} else {
+				log.Warnf("Ignoring unknown log level %q from config", cfg.Log.Level)
+			}
+			options.Debug = log.GetLevel() == log.DebugLevel
+		}
+		if cfg.Log.Format == "json" {
+			log.SetFormatter(&log.JSONFormatter{})
+		} else {
+			log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+		}
+	} else {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	}
+
 	if options.Debug {
 		log.SetLevel(log.DebugLevel)
-	} else {
+	} else if options.ConfigPath == "" || explicit["debug"] {
 		log.SetLevel(log.InfoLevel)
 	}
-	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
 
 	if options.Pattern == "" {
 		log.Fatalf("Pattern for searching log files must be provided.")
 	}
 
+	if options.FileWorkers == 0 {
+		options.FileWorkers = runtime.NumCPU()
+	}
+	if options.ParseWorkers == 0 {
+		options.ParseWorkers = runtime.NumCPU()
+	}
+
 	return options
 }
 
@@ -255,29 +524,102 @@ func main() {
 
 	log.Infoln("Found:", len(files), "files")
 
-	clients := make(map[string]*memcache.Client)
-	clients["idfa"] = memcache.New(options.IDFA)
-	clients["gaid"] = memcache.New(options.GAID)
-	clients["adid"] = memcache.New(options.ADID)
-	clients["dvid"] = memcache.New(options.DVID)
+	if options.MetricsAddr != "" {
+		ServeMetrics(options.MetricsAddr)
+		log.Infof("Serving metrics on %s\n", options.MetricsAddr)
+	}
+
+	// effectiveDry starts out equal to options.Dry, but if a dry-run sink
+	// path was given, records are routed through flushers writing to a
+	// FileSink instead of taking Record.Insert's pure-logging shortcut.
+	effectiveDry := options.Dry
+
+	flushers := make(map[string]*Flusher, len(options.Shards))
+	switch {
+	case options.Dry && options.DrySinkPath != "":
+		sink, err := NewFileSink(options.DrySinkPath)
+		if err != nil {
+			log.Fatalf("Could not open dry-run sink %s: %s", options.DrySinkPath, err)
+		}
+		dryFlusher := NewFlusher(sink, "dry", options.BatchSize, options.FlushInterval, options.MemcacheInsertMaxAttempts, options.MemcacheInsertAttemptDelay)
+		for deviceType := range options.Shards {
+			flushers[deviceType] = dryFlusher
+		}
+		effectiveDry = false
+	case options.Dry:
+		// No sink configured: ProcessLogFile takes Record.Insert's
+		// pure-logging shortcut and never touches flushers.
+	default:
+		for deviceType, shard := range options.Shards {
+			client := memcache.New(shard.Address)
+			switch {
+			case shard.DialTimeout.Duration > 0:
+				client.Timeout = shard.DialTimeout.Duration
+			case options.MemcacheDialTimeout > 0:
+				client.Timeout = options.MemcacheDialTimeout
+			}
+			sink := NewMemcacheSink(client)
+			flushers[deviceType] = NewFlusher(sink, deviceType, options.BatchSize, options.FlushInterval, options.MemcacheInsertMaxAttempts, options.MemcacheInsertAttemptDelay)
+		}
+	}
 
-	nJobs := len(files)
-	jobs := make(chan Job)
+	// ctx is cancelled on SIGINT so the dispatch loop below stops queuing
+	// further files, while files already handed to a worker keep running
+	// to completion (including their Flusher batches) rather than being
+	// abandoned mid-write.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	results := make([]chan string, nJobs)
-	for i := 0; i < nJobs; i++ {
-		results[i] = make(chan string)
+	jobs := make(chan Job, options.FileWorkers)
+	results := make(map[string]processResult, len(files))
+	var resultsMu sync.Mutex
+
+	markWorkersAlive(len(files))
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	for i := 0; i < options.FileWorkers; i++ {
+		group.Go(func() error {
+			return worker(groupCtx, jobs, options.ParseWorkers, results, &resultsMu)
+		})
 	}
 
-	for i := 0; i < nJobs; i++ {
-		go worker(jobs, results)
-		jobs <- Job{clients, files[i], options.Dry, i}
+	go func() {
+		defer close(jobs)
+		for _, file := range files {
+			select {
+			case jobs <- Job{flushers, file, effectiveDry, options.AcceptableInvalidRecordRate}:
+			case <-ctx.Done():
+				log.Warnln("Interrupted, no longer queuing new files")
+				return
+			}
+		}
+	}()
+
+	group.Wait()
+	markWorkersDone()
+
+	for _, file := range files {
+		result, ok := results[file]
+		if !ok {
+			log.Warnf("Leaving %s in place, interrupted before it finished\n", file)
+			continue
+		}
+		if !result.Clean {
+			log.Warnf("Leaving %s in place for a later run (exceeded acceptable invalid record rate)\n", result.File)
+			continue
+		}
+		log.Infof("Renaming: %s\n", result.File)
+		DotRename(result.File)
 	}
-	close(jobs)
 
-	for i := 0; i < nJobs; i++ {
-		processedFile := <-results[i]
-		log.Infof("Renaming: %s\n", processedFile)
-		DotRename(processedFile)
+	closed := make(map[*Flusher]bool, len(flushers))
+	for deviceType, flusher := range flushers {
+		if closed[flusher] {
+			continue
+		}
+		closed[flusher] = true
+
+		flusher.Close()
+		log.Infof("Flushed %s (Succeeded: %d | Failed: %d)\n", deviceType, flusher.Succeeded, flusher.Failed)
 	}
 }
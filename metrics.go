@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	linesReadTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memcload_lines_read_total",
+		Help: "Total number of log lines read across all files.",
+	})
+	parseFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memcload_parse_failures_total",
+		Help: "Total number of lines that failed to parse into a Record.",
+	})
+	recordsInsertedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memcload_records_inserted_total",
+		Help: "Records successfully inserted into Memcached, by device type.",
+	}, []string{"device_type"})
+	recordsFailedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memcload_records_failed_total",
+		Help: "Records that ultimately failed insertion into Memcached, by device type.",
+	}, []string{"device_type"})
+	memcacheSetRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memcload_memcache_set_retries_total",
+		Help: "Number of retried Set attempts, by device type.",
+	}, []string{"device_type"})
+	memcacheSetDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "memcload_memcache_set_duration_seconds",
+		Help:    "Latency of a single Memcached Set call, by device type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"device_type"})
+	inFlightBatches = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "memcload_inflight_batches",
+		Help: "Batches currently written to Memcached but not yet confirmed, by device type.",
+	}, []string{"device_type"})
+)
+
+// workersAlive is nonzero while the jobs channel still has files pending
+// or in flight; healthzHandler reports 503 once it reaches zero.
+var workersAlive int32
+
+// markWorkersAlive records that n files are queued for processing.
+func markWorkersAlive(n int) {
+	atomic.StoreInt32(&workersAlive, int32(n))
+}
+
+// markWorkersDone records that every file worker has returned, so no
+// further files will be processed.
+func markWorkersDone() {
+	atomic.StoreInt32(&workersAlive, 0)
+}
+
+// ServeMetrics starts an HTTP server exposing Prometheus metrics on
+// /metrics and a liveness probe on /healthz, listening on addr. It runs in
+// the background; since the endpoint is opt-in, a failure to serve it is
+// logged rather than treated as fatal.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Metrics server stopped: %s", err)
+		}
+	}()
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&workersAlive) > 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	markWorkersAlive(3)
+	defer markWorkersDone()
+
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got %d while workers are alive, want %d", rec.Code, http.StatusOK)
+	}
+
+	markWorkersDone()
+
+	rec = httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d once workers are done, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
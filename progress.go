@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// progressSuffix names the sibling file ProcessLogFile uses to record how
+// far into a log file it has successfully confirmed records, so a
+// crashed run can resume instead of reprocessing (and double-inserting)
+// lines.
+const progressSuffix = ".progress"
+
+func progressPath(path string) string {
+	return path + progressSuffix
+}
+
+// readProgress returns the last confirmed line offset recorded for path,
+// or 0 if there is no progress file yet, or it can't be parsed, in which
+// case processing safely restarts from the beginning.
+func readProgress(path string) int {
+	data, err := os.ReadFile(progressPath(path))
+	if err != nil {
+		return 0
+	}
+
+	offset, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return offset
+}
+
+// writeProgress records offset as the last confirmed line for path.
+func writeProgress(path string, offset int) error {
+	return os.WriteFile(progressPath(path), []byte(fmt.Sprintf("%d\n", offset)), 0o644)
+}
+
+// clearProgress removes the progress file for path once it has been
+// processed cleanly end-to-end.
+func clearProgress(path string) {
+	if err := os.Remove(progressPath(path)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Could not remove progress file for %s: %s", path, err)
+	}
+}
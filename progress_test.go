@@ -0,0 +1,132 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeGzLog gzips lines (already newline-joined) to path, for feeding
+// ProcessLogFile in tests without a real log source.
+func writeGzLog(t *testing.T, path string, lines []string) {
+	t.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	if _, err := gz.Write([]byte(strings.Join(lines, "\n") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessLogFileClearsProgressOnCleanCompletion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.log.gz")
+	writeGzLog(t, path, []string{
+		"gaid\t1\t1.0\t1.0\t1,2",
+		"gaid\t2\t1.0\t1.0\t1,2",
+		"not enough tabs",
+		"gaid\t4\t1.0\t1.0\t1,2",
+		"gaid\t5\t1.0\t1.0\t1,2",
+	})
+
+	clean := ProcessLogFile(nil, true, path, 1.0, 1)
+	if !clean {
+		t.Fatal("expected ProcessLogFile to accept the file under a 100% invalid rate")
+	}
+
+	// The file is about to be DotRenamed, so its checkpoint is no longer
+	// useful and must be gone, not merely advanced.
+	if _, err := os.Stat(progressPath(path)); !os.IsNotExist(err) {
+		t.Errorf("expected progress file to be removed on clean completion, stat error: %v", err)
+	}
+}
+
+func TestProcessLogFileClearsProgressOnReject(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.log.gz")
+	writeGzLog(t, path, []string{
+		"gaid\t1\t1.0\t1.0\t1,2",
+		"not enough tabs",
+		"also not enough tabs",
+	})
+
+	clean := ProcessLogFile(nil, true, path, 0.01, 1)
+	if clean {
+		t.Fatal("expected ProcessLogFile to reject a file exceeding the invalid rate")
+	}
+
+	if _, err := os.Stat(progressPath(path)); !os.IsNotExist(err) {
+		t.Errorf("expected progress file to be removed on reject, stat error: %v", err)
+	}
+}
+
+func TestCheckpointDecision(t *testing.T) {
+	success := lineOutcome{failed: false}
+	parseFailure := lineOutcome{failed: true, parseFailed: true}
+	insertFailure := lineOutcome{failed: true, parseFailed: false}
+
+	advance, sawInsertFailure := checkpointDecision(success, false)
+	if !advance || sawInsertFailure {
+		t.Errorf("success with no prior failure: got (advance=%v, sawInsertFailure=%v), want (true, false)", advance, sawInsertFailure)
+	}
+
+	advance, sawInsertFailure = checkpointDecision(parseFailure, false)
+	if !advance || sawInsertFailure {
+		t.Errorf("parse failure is permanent and shouldn't block the checkpoint: got (advance=%v, sawInsertFailure=%v), want (true, false)", advance, sawInsertFailure)
+	}
+
+	advance, sawInsertFailure = checkpointDecision(insertFailure, false)
+	if advance || !sawInsertFailure {
+		t.Errorf("insert failure is transient and must freeze the checkpoint: got (advance=%v, sawInsertFailure=%v), want (false, true)", advance, sawInsertFailure)
+	}
+
+	// Once an insert failure has been seen, even later successes and
+	// parse failures must not resume advancing the checkpoint.
+	advance, sawInsertFailure = checkpointDecision(success, true)
+	if advance || !sawInsertFailure {
+		t.Errorf("success after an earlier insert failure: got (advance=%v, sawInsertFailure=%v), want (false, true)", advance, sawInsertFailure)
+	}
+	advance, sawInsertFailure = checkpointDecision(parseFailure, true)
+	if advance || !sawInsertFailure {
+		t.Errorf("parse failure after an earlier insert failure: got (advance=%v, sawInsertFailure=%v), want (false, true)", advance, sawInsertFailure)
+	}
+}
+
+func TestProgressRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.log.gz")
+
+	if offset := readProgress(path); offset != 0 {
+		t.Errorf("readProgress with no file: got %d, want 0", offset)
+	}
+
+	if err := writeProgress(path, 42); err != nil {
+		t.Fatal(err)
+	}
+	if offset := readProgress(path); offset != 42 {
+		t.Errorf("readProgress after write: got %d, want 42", offset)
+	}
+
+	clearProgress(path)
+	if _, err := os.Stat(progressPath(path)); !os.IsNotExist(err) {
+		t.Errorf("expected progress file to be removed, stat error: %v", err)
+	}
+}
+
+func TestReadProgressIgnoresGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.log.gz")
+	if err := os.WriteFile(progressPath(path), []byte("not-a-number"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if offset := readProgress(path); offset != 0 {
+		t.Errorf("readProgress with garbage contents: got %d, want 0", offset)
+	}
+}
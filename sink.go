@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"os"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Sink is the destination a Flusher writes confirmed key/value pairs to.
+// MemcacheSink is the production implementation; FileSink lets a dry run
+// persist what it would have written instead of merely logging it.
+type Sink interface {
+	Put(ctx context.Context, key string, value []byte) error
+	Close() error
+}
+
+// MemcacheSink writes through a single Memcached shard.
+type MemcacheSink struct {
+	client *memcache.Client
+}
+
+// NewMemcacheSink wraps client as a Sink.
+func NewMemcacheSink(client *memcache.Client) *MemcacheSink {
+	return &MemcacheSink{client: client}
+}
+
+// Put stores key/value via the wrapped gomemcache client.
+func (s *MemcacheSink) Put(ctx context.Context, key string, value []byte) error {
+	return s.client.Set(&memcache.Item{Key: key, Value: value})
+}
+
+// Close is a no-op: *memcache.Client manages its own connection pool and
+// has nothing for callers to release.
+func (s *MemcacheSink) Close() error {
+	return nil
+}
+
+// FileSink appends length-prefixed key/value frames to a gzip-compressed
+// file. It turns a dry run into a persistent, replayable record of what
+// would have been inserted, rather than output that only exists as long
+// as the log lines scroll by.
+type FileSink struct {
+	file   *os.File
+	gz     *gzip.Writer
+	writer *bufio.Writer
+	mu     sync.Mutex
+}
+
+// NewFileSink creates (or truncates) path and returns a FileSink that
+// appends frames to it.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(file)
+	return &FileSink{file: file, gz: gz, writer: bufio.NewWriter(gz)}, nil
+}
+
+// Put appends one frame: a 4-byte big-endian key length, the key, a
+// 4-byte big-endian value length, and the value (the already
+// protobuf-encoded UserApps payload Record.Insert produced).
+func (s *FileSink) Put(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := writeFrame(s.writer, []byte(key)); err != nil {
+		return err
+	}
+	return writeFrame(s.writer, value)
+}
+
+func writeFrame(w *bufio.Writer, data []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Close flushes buffered frames and closes the gzip writer and the file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if err := s.gz.Close(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
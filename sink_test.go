@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dry-run.gz")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string][]byte{
+		"gaid:1": []byte("payload-one"),
+		"idfa:2": []byte("payload-two"),
+	}
+
+	for key, value := range records {
+		if err := sink.Put(context.Background(), key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	got := make(map[string][]byte)
+	for i := 0; i < len(records); i++ {
+		key, err := readFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := readFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[string(key)] = value
+	}
+
+	for key, value := range records {
+		gotValue, ok := got[key]
+		if !ok || string(gotValue) != string(value) {
+			t.Errorf("frame for %s: got %q, want %q", key, gotValue, value)
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}